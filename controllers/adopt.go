@@ -0,0 +1,216 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	bootstrapv1beta1 "github.com/charmed-kubernetes/cluster-api-bootstrap-provider-charmed-k8s/api/v1beta1"
+	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
+	"github.com/pkg/errors"
+)
+
+// adoptMachines takes ownership of control plane Machines that exist for the
+// cluster but were not created by this JujuControlPlane, e.g. because a user
+// bootstrapped the first node out-of-band or migrated from another provider.
+// Only Machines with no controller OwnerReference are adopted; a Machine that
+// is already controlled by another object is left alone.
+func (r *JujuControlPlaneReconciler) adoptMachines(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, desiredHash string, machines []clusterv1.Machine) error {
+	log := log.FromContext(ctx)
+
+	if !kcp.ObjectMeta.DeletionTimestamp.IsZero() {
+		return nil
+	}
+
+	for i := range machines {
+		machine := &machines[i]
+		if metav1.GetControllerOf(machine) != nil {
+			continue
+		}
+
+		logger := log.WithValues("machine", machine.Name)
+
+		configRef := machine.Spec.Bootstrap.ConfigRef
+		if configRef == nil || configRef.Kind != "CharmedK8sConfig" || configRef.APIVersion != bootstrapv1beta1.GroupVersion.String() {
+			logger.Info("refusing to adopt machine, bootstrap config is not a CharmedK8sConfig")
+			continue
+		}
+
+		if !withinOneMinor(machine.Spec.Version, kcp.Spec.Version) {
+			logger.Info("refusing to adopt machine, version is not within one minor of the control plane's desired version")
+			continue
+		}
+
+		logger.Info("adopting pre-existing control plane machine")
+		if err := r.adoptMachine(ctx, kcp, machine, configRef, desiredHash); err != nil {
+			return errors.Wrapf(err, "failed to adopt machine %s", machine.Name)
+		}
+	}
+
+	return nil
+}
+
+// adoptMachine sets a controller OwnerReference to kcp on machine, adds kcp as
+// an owner of its bootstrap CharmedK8sConfig, and pivots ownership of any
+// Secrets that config owns over to kcp.
+func (r *JujuControlPlaneReconciler) adoptMachine(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, machine *clusterv1.Machine, configRef *corev1.ObjectReference, desiredHash string) error {
+	machineHelper, err := patch.NewHelper(machine, r.Client)
+	if err != nil {
+		return err
+	}
+
+	machine.OwnerReferences = util.EnsureOwnerRef(machine.OwnerReferences, *metav1.NewControllerRef(kcp, clusterv1.GroupVersion.WithKind("JujuControlPlane")))
+	if machine.Annotations == nil {
+		machine.Annotations = map[string]string{}
+	}
+	machine.Annotations[SpecHashAnnotation] = desiredHash
+
+	if err := machineHelper.Patch(ctx, machine); err != nil {
+		return errors.Wrap(err, "failed to set owner reference on adopted machine")
+	}
+
+	return r.adoptBootstrapConfig(ctx, kcp, configRef)
+}
+
+// adoptBootstrapConfig adds kcp as an owner of a CharmedK8sConfig, keeping its
+// existing OwnerReferences (such as the Machine's), and pivots ownership of
+// any Secrets it owns over to kcp.
+func (r *JujuControlPlaneReconciler) adoptBootstrapConfig(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, configRef *corev1.ObjectReference) error {
+	config := &bootstrapv1beta1.CharmedK8sConfig{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Namespace: configRef.Namespace, Name: configRef.Name}, config); err != nil {
+		return errors.Wrap(err, "failed to get bootstrap config for adoption")
+	}
+
+	configHelper, err := patch.NewHelper(config, r.Client)
+	if err != nil {
+		return err
+	}
+	config.OwnerReferences = util.EnsureOwnerRef(config.OwnerReferences, jcpOwnerRef(kcp))
+	if err := configHelper.Patch(ctx, config); err != nil {
+		return errors.Wrap(err, "failed to set owner reference on adopted bootstrap config")
+	}
+
+	return r.adoptSecretsOwnedBy(ctx, kcp, config.Namespace, config.UID)
+}
+
+// adoptSecretsOwnedBy pivots every Secret in namespace owned by ownerUID
+// (e.g. the PKI and kubeconfig Secrets a CharmedK8sConfig generates) over to
+// kcp, so they are garbage collected with the rest of the control plane.
+func (r *JujuControlPlaneReconciler) adoptSecretsOwnedBy(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, namespace string, ownerUID types.UID) error {
+	secretList := &corev1.SecretList{}
+	if err := r.Client.List(ctx, secretList, client.InNamespace(namespace)); err != nil {
+		return errors.Wrap(err, "failed to list secrets for adoption")
+	}
+
+	for i := range secretList.Items {
+		secret := &secretList.Items[i]
+		if !ownedBy(secret.OwnerReferences, ownerUID) {
+			continue
+		}
+
+		secretHelper, err := patch.NewHelper(secret, r.Client)
+		if err != nil {
+			return err
+		}
+		refs := make([]metav1.OwnerReference, 0, len(secret.OwnerReferences))
+		for _, ref := range secret.OwnerReferences {
+			if ref.UID != ownerUID {
+				refs = append(refs, ref)
+			}
+		}
+		secret.OwnerReferences = util.EnsureOwnerRef(refs, jcpOwnerRef(kcp))
+		if err := secretHelper.Patch(ctx, secret); err != nil {
+			return errors.Wrapf(err, "failed to pivot ownership of secret %s", secret.Name)
+		}
+	}
+
+	return nil
+}
+
+func ownedBy(refs []metav1.OwnerReference, ownerUID types.UID) bool {
+	for _, ref := range refs {
+		if ref.UID == ownerUID {
+			return true
+		}
+	}
+	return false
+}
+
+func jcpOwnerRef(kcp *controlplanev1beta1.JujuControlPlane) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion:         clusterv1.GroupVersion.String(),
+		Kind:               "JujuControlPlane",
+		Name:               kcp.Name,
+		UID:                kcp.UID,
+		BlockOwnerDeletion: pointer.BoolPtr(true),
+	}
+}
+
+// withinOneMinor reports whether actual's major.minor version is within one
+// minor release of desired's. actual is nil for Machines whose version has
+// not been set yet, which we refuse to adopt.
+func withinOneMinor(actual *string, desired string) bool {
+	if actual == nil {
+		return false
+	}
+
+	aMajor, aMinor, ok := majorMinor(*actual)
+	if !ok {
+		return false
+	}
+	dMajor, dMinor, ok := majorMinor(desired)
+	if !ok {
+		return false
+	}
+
+	if aMajor != dMajor {
+		return false
+	}
+
+	diff := aMinor - dMinor
+	return diff >= -1 && diff <= 1
+}
+
+func majorMinor(version string) (major int, minor int, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
+	"github.com/pkg/errors"
+)
+
+// PreTerminateEtcdHandoffAnnotation marks a Machine as having already had its
+// etcd member handed off and removed, so a retried deletion can skip
+// straight to removing the Machine.
+const PreTerminateEtcdHandoffAnnotation = "pre-terminate.delete.hook.machine.cluster.x-k8s.io/juju-etcd-handoff"
+
+const (
+	etcdClientTimeout  = 10 * time.Second
+	etcdClientPort     = 2379
+	etcdClientCertName = "etcd-client"
+)
+
+// preTerminateMachine runs the pre-terminate hook for a control plane Machine
+// that is about to be deleted: it transfers etcd leadership off of the
+// Machine if it holds it, then evicts its etcd member. It is safe to call
+// repeatedly; once the handoff succeeds the Machine is annotated "done" and
+// subsequent calls return immediately.
+func (r *JujuControlPlaneReconciler) preTerminateMachine(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, machine *clusterv1.Machine) error {
+	log := log.FromContext(ctx)
+
+	if machine.Annotations[PreTerminateEtcdHandoffAnnotation] == "done" {
+		return nil
+	}
+
+	if machine.Status.NodeRef == nil {
+		// The Machine never joined the cluster, so it never became an etcd member.
+		return r.markEtcdHandoffDone(ctx, machine)
+	}
+
+	etcdClient, err := r.newEtcdClient(ctx, util.ObjectKey(cluster), machine)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to workload cluster etcd")
+	}
+	defer etcdClient.Close()
+
+	listCtx, cancel := context.WithTimeout(ctx, etcdClientTimeout)
+	defer cancel()
+	members, err := etcdClient.MemberList(listCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to list etcd members")
+	}
+
+	member := findEtcdMemberForNode(members.Members, machine.Status.NodeRef.Name)
+	if member == nil {
+		log.Info("no etcd member found for node, assuming already removed", "node", machine.Status.NodeRef.Name)
+		return r.markEtcdHandoffDone(ctx, machine)
+	}
+
+	if soleRemainingMember(members.Members, member.ID) {
+		// There is no other member to hand leadership or the removal call
+		// itself off to, and tearing down the last etcd member isn't
+		// something MemberRemove needs to do: the Machine delete that follows
+		// takes the whole cluster, member list included, with it.
+		log.Info("machine is the sole remaining etcd member, skipping leadership transfer and member removal", "node", machine.Status.NodeRef.Name)
+		return r.markEtcdHandoffDone(ctx, machine)
+	}
+
+	statusCtx, cancel := context.WithTimeout(ctx, etcdClientTimeout)
+	defer cancel()
+	memberStatus, err := etcdClient.Status(statusCtx, member.ClientURLs[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to get etcd member status")
+	}
+
+	if memberStatus.Leader == member.ID {
+		log.Info("transferring etcd leadership off of machine", "node", machine.Status.NodeRef.Name)
+		if err := transferEtcdLeadership(ctx, etcdClient, members.Members, member.ID); err != nil {
+			return errors.Wrap(err, "failed to transfer etcd leadership")
+		}
+	}
+
+	removeCtx, cancel := context.WithTimeout(ctx, etcdClientTimeout)
+	defer cancel()
+	if _, err := etcdClient.MemberRemove(removeCtx, member.ID); err != nil {
+		return errors.Wrap(err, "failed to remove etcd member")
+	}
+
+	log.Info("removed etcd member", "node", machine.Status.NodeRef.Name)
+	return r.markEtcdHandoffDone(ctx, machine)
+}
+
+func transferEtcdLeadership(ctx context.Context, etcdClient *clientv3.Client, members []*etcdserverpb.Member, leavingID uint64) error {
+	for _, member := range members {
+		if member.ID == leavingID || len(member.ClientURLs) == 0 {
+			continue
+		}
+
+		moveCtx, cancel := context.WithTimeout(ctx, etcdClientTimeout)
+		defer cancel()
+		_, err := etcdClient.MoveLeader(moveCtx, member.ID)
+		return err
+	}
+
+	return errors.New("no remaining etcd member to transfer leadership to")
+}
+
+// soleRemainingMember reports whether memberID is the only member in members.
+func soleRemainingMember(members []*etcdserverpb.Member, memberID uint64) bool {
+	for _, member := range members {
+		if member.ID != memberID {
+			return false
+		}
+	}
+	return true
+}
+
+func findEtcdMemberForNode(members []*etcdserverpb.Member, nodeName string) *etcdserverpb.Member {
+	for _, member := range members {
+		if member.Name == nodeName {
+			return member
+		}
+	}
+	return nil
+}
+
+func (r *JujuControlPlaneReconciler) markEtcdHandoffDone(ctx context.Context, machine *clusterv1.Machine) error {
+	if machine.Annotations == nil {
+		machine.Annotations = map[string]string{}
+	}
+	machine.Annotations[PreTerminateEtcdHandoffAnnotation] = "done"
+	return r.Client.Update(ctx, machine)
+}
+
+// newEtcdClient dials the etcd member running on machine's node, authenticating
+// with a short-lived client certificate signed by the cluster CA.
+func (r *JujuControlPlaneReconciler) newEtcdClient(ctx context.Context, clusterKey client.ObjectKey, machine *clusterv1.Machine) (*clientv3.Client, error) {
+	host := nodeInternalIP(machine)
+	if host == "" {
+		return nil, errors.Errorf("machine %s has no internal IP address", machine.Name)
+	}
+
+	cluster := &clusterv1.Cluster{}
+	if err := r.Client.Get(ctx, clusterKey, cluster); err != nil {
+		return nil, errors.Wrap(err, "failed to get cluster")
+	}
+
+	ca, err := r.getClusterCA(ctx, cluster)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get cluster CA")
+	}
+
+	certPEM, keyPEM, err := newClientCert(ca, etcdClientCertName, nil, adminCertValidity)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to issue etcd client certificate")
+	}
+
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse etcd client certificate")
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(ca.certPEM)
+
+	return clientv3.New(clientv3.Config{
+		Endpoints:   []string{fmt.Sprintf("https://%s:%d", host, etcdClientPort)},
+		DialTimeout: etcdClientTimeout,
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      certPool,
+		},
+	})
+}
+
+func nodeInternalIP(machine *clusterv1.Machine) string {
+	for _, addr := range machine.Status.Addresses {
+		if addr.Type == clusterv1.MachineInternalIP {
+			return addr.Address
+		}
+	}
+	return ""
+}
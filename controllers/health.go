@@ -0,0 +1,63 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
+)
+
+// HealthCheckFailedRequeueAfter is how long to wait before retrying a scale
+// operation that was deferred because an existing Machine had not yet joined
+// the cluster or the workload cluster's control plane/etcd were not healthy.
+const HealthCheckFailedRequeueAfter = 20 * time.Second
+
+// canScale reports whether it is safe to create or remove a control plane
+// Machine: every existing Machine must have a NodeRef and be Ready, and the
+// workload cluster's control plane and etcd must both report healthy. This
+// keeps scale-up serialized and keeps us from removing a member while the
+// cluster can't tolerate losing one.
+func (r *JujuControlPlaneReconciler) canScale(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, machines []clusterv1.Machine) bool {
+	log := log.FromContext(ctx)
+
+	for _, machine := range machines {
+		if machine.Status.NodeRef == nil || !machineIsReady(machine) {
+			log.Info("deferring scale operation, machine has not joined the cluster yet", "machine", machine.Name)
+			return false
+		}
+	}
+
+	clusterKey := util.ObjectKey(cluster)
+
+	if err := r.managementCluster().TargetClusterControlPlaneIsHealthy(ctx, clusterKey, kcp.Name); err != nil {
+		log.Info("deferring scale operation, target cluster control plane is not healthy", "reason", err.Error())
+		return false
+	}
+
+	if err := r.managementCluster().TargetClusterEtcdIsHealthy(ctx, clusterKey, kcp.Name); err != nil {
+		log.Info("deferring scale operation, target cluster etcd is not healthy", "reason", err.Error())
+		return false
+	}
+
+	return true
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sort"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -35,12 +36,16 @@ import (
 	"sigs.k8s.io/cluster-api/util/conditions"
 	"sigs.k8s.io/cluster-api/util/patch"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	bootstrapv1beta1 "github.com/charmed-kubernetes/cluster-api-bootstrap-provider-charmed-k8s/api/v1beta1"
 
+	internalcluster "github.com/charmed-kubernetes/cluster-api-control-plane-provider-charmed-k8s/internal/cluster"
 	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
 	"github.com/pkg/errors"
 )
@@ -57,6 +62,24 @@ type ControlPlane struct {
 type JujuControlPlaneReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// ManagementCluster is used to query the health of the workload cluster's
+	// control plane and etcd before scaling. Defaults to a ManagementCluster
+	// built from this reconciler's client if left nil.
+	ManagementCluster *internalcluster.ManagementCluster
+
+	// externalTracker lets us start a watch on the infrastructure MachineTemplate
+	// the first time we resolve it, without knowing its concrete GVK up front.
+	externalTracker external.ObjectTracker
+}
+
+// managementCluster returns r.ManagementCluster, lazily defaulting it so that
+// tests and callers don't have to construct one by hand.
+func (r *JujuControlPlaneReconciler) managementCluster() *internalcluster.ManagementCluster {
+	if r.ManagementCluster == nil {
+		r.ManagementCluster = &internalcluster.ManagementCluster{Client: r.Client}
+	}
+	return r.ManagementCluster
 }
 
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;patch
@@ -144,7 +167,12 @@ func (r *JujuControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, nil
 	}
 
-	// TODO: handle proper adoption of Machines
+	log.Info("reconciling workload cluster kubeconfig")
+	if err := r.reconcileKubeconfig(ctx, cluster, kcp); err != nil {
+		log.Error(err, "failed to reconcile workload cluster kubeconfig")
+		return ctrl.Result{}, err
+	}
+
 	log.Info("Getting control plane machines")
 	ownedMachines, err := r.getControlPlaneMachinesForCluster(ctx, util.ObjectKey(cluster))
 	if err != nil {
@@ -152,6 +180,32 @@ func (r *JujuControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, err
 	}
 
+	desiredHash, err := r.computeDesiredSpecHash(ctx, kcp, cluster)
+	if err != nil {
+		log.Error(err, "failed to compute desired spec hash")
+		return ctrl.Result{}, err
+	}
+
+	log.Info("adopting pre-existing control plane machines")
+	if err := r.adoptMachines(ctx, kcp, desiredHash, ownedMachines); err != nil {
+		log.Error(err, "failed to adopt control plane machines")
+		return ctrl.Result{}, err
+	}
+
+	if !cluster.Status.ControlPlaneInitialized {
+		for _, machine := range ownedMachines {
+			if machine.Status.NodeRef != nil {
+				log.Info("first control plane machine has a NodeRef, marking cluster control plane initialized")
+				cluster.Status.ControlPlaneInitialized = true
+				if err := r.Client.Status().Update(ctx, cluster); err != nil {
+					log.Error(err, "failed to mark cluster control plane initialized")
+					return ctrl.Result{}, err
+				}
+				break
+			}
+		}
+	}
+
 	log.Info("setting MachinesReady condition based on aggregate status of owned machines")
 	conditionGetters := make([]conditions.Getter, len(ownedMachines))
 	for i, v := range ownedMachines {
@@ -160,7 +214,7 @@ func (r *JujuControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Req
 	conditions.SetAggregate(kcp, controlplanev1beta1.MachinesReadyCondition, conditionGetters, conditions.AddSourceRef(), conditions.WithStepCounterIf(false))
 
 	log.Info("reconciling machines")
-	result, err := r.reconcileMachines(ctx, cluster, kcp, ownedMachines)
+	result, err := r.reconcileMachines(ctx, cluster, kcp, ownedMachines, desiredHash)
 	if err != nil {
 		log.Error(err, "error reconciling machines")
 		return ctrl.Result{}, err
@@ -171,9 +225,25 @@ func (r *JujuControlPlaneReconciler) Reconcile(ctx context.Context, req ctrl.Req
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *JujuControlPlaneReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&controlplanev1beta1.JujuControlPlane{}).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &clusterv1.Machine{}},
+			handler.EnqueueRequestsFromMapFunc(r.machineToJujuControlPlane),
+		).
+		Watches(
+			&source.Kind{Type: &clusterv1.Cluster{}},
+			handler.EnqueueRequestsFromMapFunc(r.clusterToJujuControlPlane),
+			builder.WithPredicates(clusterUpdatePredicate()),
+		).
+		Build(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to build controller")
+	}
+
+	r.externalTracker = external.ObjectTracker{Controller: c}
+
+	return nil
 }
 
 func (r *JujuControlPlaneReconciler) reconcileExternalReference(ctx context.Context, ref corev1.ObjectReference, cluster *clusterv1.Cluster) error {
@@ -182,6 +252,10 @@ func (r *JujuControlPlaneReconciler) reconcileExternalReference(ctx context.Cont
 		return err
 	}
 
+	if err := r.externalTracker.Watch(log.FromContext(ctx), obj, handler.EnqueueRequestsFromMapFunc(r.templateToJujuControlPlane)); err != nil {
+		return errors.Wrap(err, "failed to set up watch on external reference")
+	}
+
 	objPatchHelper, err := patch.NewHelper(obj, r.Client)
 	if err != nil {
 		return err
@@ -216,7 +290,7 @@ func (r *JujuControlPlaneReconciler) getControlPlaneMachinesForCluster(ctx conte
 	return machineList.Items, nil
 }
 
-func (r *JujuControlPlaneReconciler) reconcileMachines(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, machines []clusterv1.Machine) (res ctrl.Result, err error) {
+func (r *JujuControlPlaneReconciler) reconcileMachines(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, machines []clusterv1.Machine, desiredHash string) (res ctrl.Result, err error) {
 	log := log.FromContext(ctx)
 	// If we've made it this far, we can assume that all ownedMachines are up to date
 	numMachines := len(machines)
@@ -230,16 +304,30 @@ func (r *JujuControlPlaneReconciler) reconcileMachines(ctx context.Context, clus
 		// Create new Machine
 		log.Info("initializing control plane")
 
-		return r.bootControlPlane(ctx, cluster, kcp, controlPlane)
+		return r.bootControlPlane(ctx, cluster, kcp, controlPlane, desiredHash)
 
 	// We are scaling up
 	case numMachines < desiredReplicas && numMachines > 0:
 		conditions.MarkFalse(kcp, controlplanev1beta1.ResizedCondition, controlplanev1beta1.ScalingUpReason, clusterv1.ConditionSeverityWarning,
 			"Scaling up control plane to %d replicas (actual %d)", desiredReplicas, numMachines)
 
+		if !r.canScale(ctx, cluster, kcp, machines) {
+			log.Info("deferring control plane scale up until existing machines and the target cluster are healthy")
+			return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+		}
+
 		// Create a new Machine
 		log.Info("scaling up control plane")
-		return r.bootControlPlane(ctx, cluster, kcp, controlPlane)
+		return r.bootControlPlane(ctx, cluster, kcp, controlPlane, desiredHash)
+
+	// One or more machines are running a stale MachineTemplate/ControlPlaneConfig:
+	// drive a rollout. This must be checked before the scale-down case below,
+	// since a RollingUpdate surges an extra machine ahead of retiring the old
+	// one and would otherwise be misrouted into a generic scale-down as soon
+	// as the machine count temporarily exceeds desiredReplicas.
+	case len(outOfDateMachines(machines, desiredHash)) > 0:
+		log.Info("rolling out control plane machines that do not match the desired spec")
+		return r.rolloutControlPlane(ctx, cluster, kcp, controlPlane, desiredHash)
 
 	// We are scaling down
 	case numMachines > desiredReplicas:
@@ -247,8 +335,13 @@ func (r *JujuControlPlaneReconciler) reconcileMachines(ctx context.Context, clus
 			"Scaling down control plane to %d replicas (actual %d)",
 			desiredReplicas, numMachines)
 
+		if !r.canScale(ctx, cluster, kcp, machines) {
+			log.Info("deferring control plane scale down until existing machines and the target cluster are healthy")
+			return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+		}
+
 		log.Info("scaling down control plane")
-		res, err = r.scaleDownControlPlane(ctx, kcp, util.ObjectKey(cluster), controlPlane.KCP.Name, machines)
+		res, err = r.scaleDownControlPlane(ctx, kcp, util.ObjectKey(cluster), controlPlane.KCP.Name, machines, desiredHash)
 		if err != nil {
 			if res.Requeue || res.RequeueAfter > 0 {
 				log.Error(err, "failed to scale down control plane")
@@ -280,7 +373,7 @@ func (r *JujuControlPlaneReconciler) newControlPlane(cluster *clusterv1.Cluster,
 	}
 }
 
-func (r *JujuControlPlaneReconciler) bootControlPlane(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, controlPlane *ControlPlane) (ctrl.Result, error) {
+func (r *JujuControlPlaneReconciler) bootControlPlane(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, controlPlane *ControlPlane, desiredHash string) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
 	// Since the cloned resource should eventually have a controller ref for the Machine, we create an
@@ -326,6 +419,9 @@ func (r *JujuControlPlaneReconciler) bootControlPlane(ctx context.Context, clust
 				clusterv1.ClusterLabelName:             cluster.Name,
 				clusterv1.MachineControlPlaneLabelName: "",
 			},
+			Annotations: map[string]string{
+				SpecHashAnnotation: desiredHash,
+			},
 			OwnerReferences: []metav1.OwnerReference{
 				*metav1.NewControllerRef(kcp, clusterv1.GroupVersion.WithKind("JujuControlPlane")),
 			},
@@ -370,26 +466,33 @@ func (r *JujuControlPlaneReconciler) getFailureDomain(ctx context.Context, clust
 	return retList
 }
 
-func (r *JujuControlPlaneReconciler) scaleDownControlPlane(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, cluster client.ObjectKey, cpName string, machines []clusterv1.Machine) (ctrl.Result, error) {
+func (r *JujuControlPlaneReconciler) scaleDownControlPlane(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, clusterKey client.ObjectKey, cpName string, machines []clusterv1.Machine, desiredHash string) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 	if len(machines) == 0 {
 		return ctrl.Result{}, fmt.Errorf("no machines found")
 	}
 	log.WithValues("machines", len(machines)).Info("found control plane machines")
-	deleteMachine := machines[len(machines)-1]
-	machine := machines[len(machines)-1]
-	for i := len(machines) - 1; i >= 0; i-- {
-		machine = machines[i]
-		logger := log.WithValues("machineName", machine.Name)
+	for _, machine := range machines {
 		if !machine.ObjectMeta.DeletionTimestamp.IsZero() {
-			logger.Info("machine is in process of deletion")
-		}
-		// mark the oldest machine to be deleted first
-		if machine.CreationTimestamp.Before(&deleteMachine.CreationTimestamp) {
-			deleteMachine = machine
+			log.WithValues("machineName", machine.Name).Info("machine is in process of deletion")
 		}
 	}
 
+	// Prefer removing a machine that no longer matches the desired spec; fall
+	// back to the oldest machine as a tiebreaker.
+	deleteMachine := selectMachineToDelete(machines, desiredHash)
+
+	cluster := &clusterv1.Cluster{}
+	if err := r.Client.Get(ctx, clusterKey, cluster); err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "failed to get cluster")
+	}
+
+	log.WithValues("machineName", deleteMachine.Name).Info("running pre-terminate etcd handoff")
+	if err := r.preTerminateMachine(ctx, cluster, kcp, &deleteMachine); err != nil {
+		log.Error(err, "pre-terminate etcd handoff failed, deferring machine deletion", "machineName", deleteMachine.Name)
+		return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+	}
+
 	log.WithValues("machineName", deleteMachine.Name).Info("deleting machine")
 
 	err := r.Client.Delete(ctx, &deleteMachine)
@@ -409,9 +512,13 @@ func (r *JujuControlPlaneReconciler) reconcileDelete(ctx context.Context, cluste
 		return ctrl.Result{}, err
 	}
 
-	// If no control plane machines remain, remove the finalizer
+	// If no control plane machines remain, clean up the kubeconfig secret and
+	// remove the finalizer.
 	if len(ownedMachines) == 0 {
 		log.Info("no machines exist")
+		if err := r.deleteKubeconfigSecret(ctx, cluster); err != nil {
+			return ctrl.Result{}, err
+		}
 		if controllerutil.ContainsFinalizer(kcp, controlplanev1beta1.JujuControlPlaneFinalizer) {
 			log.Info("removing finalizer and stopping reconciliation")
 			controllerutil.RemoveFinalizer(kcp, controlplanev1beta1.JujuControlPlaneFinalizer)
@@ -419,18 +526,35 @@ func (r *JujuControlPlaneReconciler) reconcileDelete(ctx context.Context, cluste
 		}
 	}
 
-	for _, ownedMachine := range ownedMachines {
+	// Tear down machines one at a time, oldest first, so etcd members are
+	// handed off and removed in order instead of racing each other.
+	remaining := make([]clusterv1.Machine, len(ownedMachines))
+	copy(remaining, ownedMachines)
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].CreationTimestamp.Before(&remaining[j].CreationTimestamp)
+	})
+
+	for i := range remaining {
+		ownedMachine := remaining[i]
 		// Already deleting this machine
 		if !ownedMachine.ObjectMeta.DeletionTimestamp.IsZero() {
 			continue
 		}
+
+		if err := r.preTerminateMachine(ctx, cluster, kcp, &ownedMachine); err != nil {
+			log.Error(err, "pre-terminate etcd handoff failed, deferring machine deletion", "machineName", ownedMachine.Name)
+			return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+		}
+
 		// Submit deletion request
 		if err := r.Client.Delete(ctx, &ownedMachine); err != nil && !apierrors.IsNotFound(err) {
 			return ctrl.Result{}, err
 		}
-	}
 
-	// TODO: clean up secrets for kubeconfig once that is implemented
+		// Requeue to tear down the next machine; a machine that is already
+		// being deleted is skipped on later passes rather than waited on.
+		return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+	}
 
 	conditions.MarkFalse(kcp, clusterv1.ResizedCondition, clusterv1.DeletingReason, clusterv1.ConditionSeverityInfo, "")
 	// Requeue the deletion so we can check to make sure machines got cleaned up
@@ -0,0 +1,301 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// clusterSecretType mirrors the type CAPI uses to tag cluster-scoped
+	// Secrets (CA, kubeconfig, ...) so clusterctl move and other tooling can
+	// find and migrate them alongside the Cluster.
+	clusterSecretType corev1.SecretType = "cluster.x-k8s.io/secret"
+
+	adminCertValidity = 365 * 24 * time.Hour
+	// rotateAfterFraction is the fraction of the admin cert's lifetime after
+	// which we reissue it, i.e. once it is within 20% of expiry.
+	rotateAfterFraction = 0.8
+)
+
+func caSecretName(clusterName string) string {
+	return fmt.Sprintf("%s-ca", clusterName)
+}
+
+func kubeconfigSecretName(clusterName string) string {
+	return fmt.Sprintf("%s-kubeconfig", clusterName)
+}
+
+// reconcileKubeconfig ensures a <cluster>-kubeconfig Secret exists for the
+// workload cluster, rotating the embedded admin client certificate as it
+// approaches expiry.
+func (r *JujuControlPlaneReconciler) reconcileKubeconfig(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane) error {
+	log := log.FromContext(ctx)
+
+	ca, err := r.getClusterCA(ctx, cluster)
+	if err != nil {
+		return errors.Wrap(err, "failed to get cluster CA")
+	}
+
+	secretKey := client.ObjectKey{Namespace: cluster.Namespace, Name: kubeconfigSecretName(cluster.Name)}
+	secret := &corev1.Secret{}
+	err = r.Client.Get(ctx, secretKey, secret)
+	switch {
+	case apierrors.IsNotFound(err):
+		log.Info("generating workload cluster kubeconfig secret")
+		return r.createKubeconfigSecret(ctx, cluster, kcp, ca)
+	case err != nil:
+		return errors.Wrap(err, "failed to get kubeconfig secret")
+	}
+
+	needsRotation, err := clientCertNeedsRotation(secret.Data["value"])
+	if err != nil {
+		return errors.Wrap(err, "failed to inspect kubeconfig admin client certificate")
+	}
+	if !needsRotation {
+		return nil
+	}
+
+	log.Info("rotating workload cluster kubeconfig admin client certificate")
+	kubeconfig, err := buildAdminKubeconfig(cluster, ca)
+	if err != nil {
+		return errors.Wrap(err, "failed to build kubeconfig")
+	}
+	secret.Data = map[string][]byte{"value": kubeconfig}
+	return r.Client.Update(ctx, secret)
+}
+
+func (r *JujuControlPlaneReconciler) createKubeconfigSecret(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, ca *caKeyPair) error {
+	kubeconfig, err := buildAdminKubeconfig(cluster, ca)
+	if err != nil {
+		return errors.Wrap(err, "failed to build kubeconfig")
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kubeconfigSecretName(cluster.Name),
+			Namespace: cluster.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(kcp, clusterv1.GroupVersion.WithKind("JujuControlPlane")),
+			},
+		},
+		Type: clusterSecretType,
+		Data: map[string][]byte{"value": kubeconfig},
+	}
+
+	if err := r.Client.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrap(err, "failed to create kubeconfig secret")
+	}
+
+	return nil
+}
+
+// deleteKubeconfigSecret removes the workload cluster's kubeconfig Secret as
+// part of tearing down the control plane.
+func (r *JujuControlPlaneReconciler) deleteKubeconfigSecret(ctx context.Context, cluster *clusterv1.Cluster) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kubeconfigSecretName(cluster.Name),
+			Namespace: cluster.Namespace,
+		},
+	}
+	if err := r.Client.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrap(err, "failed to delete kubeconfig secret")
+	}
+	return nil
+}
+
+// caKeyPair holds a decoded certificate authority and its PEM encodings,
+// ready to sign client certificates or be stored back into a Secret.
+type caKeyPair struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// getClusterCA reads the workload cluster's CA out of the <cluster>-ca
+// Secret published by the bootstrap provider. We never mint a CA of our own
+// here: the real kube-apiserver and etcd only trust the CA the bootstrap
+// provider bootstrapped the cluster with, so until that Secret exists there
+// is nothing we can issue client certificates against.
+func (r *JujuControlPlaneReconciler) getClusterCA(ctx context.Context, cluster *clusterv1.Cluster) (*caKeyPair, error) {
+	secretKey := client.ObjectKey{Namespace: cluster.Namespace, Name: caSecretName(cluster.Name)}
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, secretKey, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, errors.Errorf("cluster CA secret %s not yet published by the bootstrap provider", secretKey.Name)
+		}
+		return nil, errors.Wrap(err, "failed to get cluster CA secret")
+	}
+
+	keyPEM, ok := secret.Data["tls.key"]
+	if !ok {
+		return nil, errors.New("cluster CA secret does not contain a private key, cannot issue client certificates")
+	}
+
+	return decodeCAKeyPair(secret.Data["tls.crt"], keyPEM)
+}
+
+func decodeCAKeyPair(certPEM, keyPEM []byte) (*caKeyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("failed to decode CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA certificate")
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("failed to decode CA private key PEM")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA private key")
+	}
+
+	return &caKeyPair{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+// newAdminClientCert issues a short-lived client certificate, signed by ca,
+// authenticating as the cluster-admin user.
+func newAdminClientCert(ca *caKeyPair) (certPEM, keyPEM []byte, err error) {
+	return newClientCert(ca, "admin", []string{"system:masters"}, adminCertValidity)
+}
+
+// newClientCert issues a short-lived client certificate signed by ca.
+func newClientCert(ca *caKeyPair, commonName string, organizations []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: organizations,
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+func buildAdminKubeconfig(cluster *clusterv1.Cluster, ca *caKeyPair) ([]byte, error) {
+	certPEM, keyPEM, err := newAdminClientCert(ca)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to issue admin client certificate")
+	}
+
+	endpoint := fmt.Sprintf("https://%s:%d", cluster.Spec.ControlPlaneEndpoint.Host, cluster.Spec.ControlPlaneEndpoint.Port)
+	contextName := fmt.Sprintf("%s-admin@%s", cluster.Name, cluster.Name)
+
+	config := clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			cluster.Name: {
+				Server:                   endpoint,
+				CertificateAuthorityData: ca.certPEM,
+			},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			contextName: {
+				Cluster:  cluster.Name,
+				AuthInfo: fmt.Sprintf("%s-admin", cluster.Name),
+			},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			fmt.Sprintf("%s-admin", cluster.Name): {
+				ClientCertificateData: certPEM,
+				ClientKeyData:         keyPEM,
+			},
+		},
+		CurrentContext: contextName,
+	}
+
+	return clientcmd.Write(config)
+}
+
+// clientCertNeedsRotation reports whether the admin client certificate
+// embedded in a kubeconfig has used up rotateAfterFraction of its lifetime.
+func clientCertNeedsRotation(kubeconfig []byte) (bool, error) {
+	if len(kubeconfig) == 0 {
+		return true, nil
+	}
+
+	config, err := clientcmd.Load(kubeconfig)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to parse kubeconfig")
+	}
+
+	authInfo, ok := config.AuthInfos[fmt.Sprintf("%s-admin", currentContextCluster(config))]
+	if !ok || len(authInfo.ClientCertificateData) == 0 {
+		return true, nil
+	}
+
+	block, _ := pem.Decode(authInfo.ClientCertificateData)
+	if block == nil {
+		return true, nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true, nil
+	}
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	rotateAt := cert.NotBefore.Add(time.Duration(float64(lifetime) * rotateAfterFraction))
+	return time.Now().After(rotateAt), nil
+}
+
+func currentContextCluster(config *clientcmdapi.Config) string {
+	if ctx, ok := config.Contexts[config.CurrentContext]; ok {
+		return ctx.Cluster
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/controllers/external"
+	"sigs.k8s.io/cluster-api/util/conditions"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	bootstrapv1beta1 "github.com/charmed-kubernetes/cluster-api-bootstrap-provider-charmed-k8s/api/v1beta1"
+	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
+	"github.com/pkg/errors"
+)
+
+// SpecHashAnnotation is stamped on every control plane Machine with the hash
+// of the MachineTemplate/ControlPlaneConfig it was booted from, so that we can
+// later detect it has drifted from the JujuControlPlane's current spec.
+const SpecHashAnnotation = "controlplane.cluster.x-k8s.io/juju-spec-hash"
+
+// computeDesiredSpecHash returns a stable hash over the resolved
+// infrastructure template's spec.template.spec and the ControlPlaneConfig.
+// Machines whose SpecHashAnnotation differs from this value are out of date.
+func (r *JujuControlPlaneReconciler) computeDesiredSpecHash(ctx context.Context, kcp *controlplanev1beta1.JujuControlPlane, cluster *clusterv1.Cluster) (string, error) {
+	template, err := external.Get(ctx, r.Client, &kcp.Spec.MachineTemplate, cluster.Namespace)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to retrieve machine template")
+	}
+
+	templateSpec, _, err := unstructured.NestedMap(template.Object, "spec", "template", "spec")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read machine template spec")
+	}
+
+	data, err := json.Marshal(struct {
+		TemplateSpec       map[string]interface{}                `json:"templateSpec"`
+		ControlPlaneConfig bootstrapv1beta1.CharmedK8sConfigSpec `json:"controlPlaneConfig"`
+	}{
+		TemplateSpec:       templateSpec,
+		ControlPlaneConfig: kcp.Spec.ControlPlaneConfig,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal desired control plane spec")
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// outOfDateMachines returns the subset of machines whose SpecHashAnnotation
+// does not match desiredHash, oldest first.
+func outOfDateMachines(machines []clusterv1.Machine, desiredHash string) []clusterv1.Machine {
+	var outdated []clusterv1.Machine
+	for _, machine := range machines {
+		if machine.Annotations[SpecHashAnnotation] != desiredHash {
+			outdated = append(outdated, machine)
+		}
+	}
+
+	sort.Slice(outdated, func(i, j int) bool {
+		return outdated[i].CreationTimestamp.Before(&outdated[j].CreationTimestamp)
+	})
+
+	return outdated
+}
+
+// selectMachineToDelete picks the Machine to remove on scale-down: an
+// out-of-date machine is preferred so rollouts make progress, falling back to
+// the oldest machine as a tiebreaker.
+func selectMachineToDelete(machines []clusterv1.Machine, desiredHash string) clusterv1.Machine {
+	if outdated := outOfDateMachines(machines, desiredHash); len(outdated) > 0 {
+		return outdated[0]
+	}
+
+	deleteMachine := machines[0]
+	for _, machine := range machines[1:] {
+		if machine.CreationTimestamp.Before(&deleteMachine.CreationTimestamp) {
+			deleteMachine = machine
+		}
+	}
+	return deleteMachine
+}
+
+// machineIsReady reports whether a control plane Machine has joined the
+// cluster and is reporting Ready.
+func machineIsReady(machine clusterv1.Machine) bool {
+	return machine.Status.NodeRef != nil && conditions.IsTrue(&machine, clusterv1.ReadyCondition)
+}
+
+// rolloutControlPlane drives machines whose SpecHashAnnotation no longer
+// matches desiredHash towards the current MachineTemplate/ControlPlaneConfig,
+// following kcp.Spec.RolloutStrategy.
+func (r *JujuControlPlaneReconciler) rolloutControlPlane(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, controlPlane *ControlPlane, desiredHash string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	strategy := controlplanev1beta1.RollingUpdateStrategyType
+	if kcp.Spec.RolloutStrategy != nil && kcp.Spec.RolloutStrategy.Type != "" {
+		strategy = kcp.Spec.RolloutStrategy.Type
+	}
+
+	outdated := outOfDateMachines(controlPlane.Machines, desiredHash)
+
+	if strategy == controlplanev1beta1.RecreateStrategyType {
+		// Recreate exists for specs the existing machines can't become
+		// healthy on, so retiring them can't wait on canScale - that would
+		// require the very machines driving the rollout to already be Ready.
+		log.Info("retiring an out-of-date control plane machine", "remaining", len(outdated))
+		return r.retireOutOfDateMachine(ctx, cluster, kcp, outdated[0])
+	}
+
+	if !r.canScale(ctx, cluster, kcp, controlPlane.Machines) {
+		log.Info("deferring rollout until existing machines and the target cluster are healthy")
+		return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+	}
+
+	desiredReplicas := int(*kcp.Spec.Replicas)
+
+	maxSurge := 1
+	if kcp.Spec.RolloutStrategy != nil && kcp.Spec.RolloutStrategy.RollingUpdate != nil && kcp.Spec.RolloutStrategy.RollingUpdate.MaxSurge != nil {
+		var err error
+		maxSurge, err = intstr.GetScaledValueFromIntOrPercent(kcp.Spec.RolloutStrategy.RollingUpdate.MaxSurge, desiredReplicas, true)
+		if err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "invalid RolloutStrategy.RollingUpdate.MaxSurge")
+		}
+	}
+
+	surplus := len(controlPlane.Machines) - desiredReplicas
+
+	if surplus < maxSurge {
+		log.Info("surging a replacement control plane machine ahead of rollout")
+		return r.bootControlPlane(ctx, cluster, kcp, controlPlane, desiredHash)
+	}
+
+	upToDate := make([]clusterv1.Machine, 0, len(controlPlane.Machines))
+	for _, machine := range controlPlane.Machines {
+		if machine.Annotations[SpecHashAnnotation] == desiredHash {
+			upToDate = append(upToDate, machine)
+		}
+	}
+	for _, machine := range upToDate {
+		if !machineIsReady(machine) {
+			log.Info("waiting for surged control plane machine to become ready", "machine", machine.Name)
+			return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+		}
+	}
+
+	return r.retireOutOfDateMachine(ctx, cluster, kcp, outdated[0])
+}
+
+// retireOutOfDateMachine runs the same etcd pre-terminate handoff
+// scaleDownControlPlane and reconcileDelete use before deleting machine, so a
+// rollout never removes an etcd member without first moving leadership and
+// membership off of it.
+func (r *JujuControlPlaneReconciler) retireOutOfDateMachine(ctx context.Context, cluster *clusterv1.Cluster, kcp *controlplanev1beta1.JujuControlPlane, machine clusterv1.Machine) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	log.WithValues("machineName", machine.Name).Info("running pre-terminate etcd handoff")
+	if err := r.preTerminateMachine(ctx, cluster, kcp, &machine); err != nil {
+		log.Error(err, "pre-terminate etcd handoff failed, deferring machine deletion", "machineName", machine.Name)
+		return ctrl.Result{RequeueAfter: HealthCheckFailedRequeueAfter}, nil
+	}
+
+	log.WithValues("machineName", machine.Name).Info("deleting out-of-date control plane machine")
+	if err := r.Client.Delete(ctx, &machine); err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, errors.Wrap(err, "failed to delete out-of-date machine")
+	}
+
+	return ctrl.Result{Requeue: true}, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/annotations"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	controlplanev1beta1 "github.com/charmed-kubernetes/cluster-api-control-plane-provider-juju/api/v1beta1"
+)
+
+// machineToJujuControlPlane maps a control plane Machine back to the
+// JujuControlPlane that owns it, so Machine Ready transitions and deletions
+// trigger a reconcile instead of waiting on the next RequeueAfter.
+func (r *JujuControlPlaneReconciler) machineToJujuControlPlane(o client.Object) []reconcile.Request {
+	owner := metav1.GetControllerOf(o)
+	if owner == nil || owner.Kind != "JujuControlPlane" {
+		return nil
+	}
+
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: o.GetNamespace(), Name: owner.Name},
+	}}
+}
+
+// clusterToJujuControlPlane maps a Cluster to the JujuControlPlane named by
+// its Spec.ControlPlaneRef, so an endpoint becoming valid or the pause
+// annotation toggling triggers a reconcile.
+func (r *JujuControlPlaneReconciler) clusterToJujuControlPlane(o client.Object) []reconcile.Request {
+	cluster, ok := o.(*clusterv1.Cluster)
+	if !ok {
+		return nil
+	}
+
+	ref := cluster.Spec.ControlPlaneRef
+	if ref == nil || ref.Kind != "JujuControlPlane" {
+		return nil
+	}
+
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: cluster.Namespace, Name: ref.Name},
+	}}
+}
+
+// templateToJujuControlPlane maps an infrastructure MachineTemplate back to
+// the JujuControlPlane(s) whose Spec.MachineTemplate references it, so
+// template edits are picked up without waiting on a polling requeue.
+func (r *JujuControlPlaneReconciler) templateToJujuControlPlane(o client.Object) []reconcile.Request {
+	kcpList := &controlplanev1beta1.JujuControlPlaneList{}
+	if err := r.Client.List(context.Background(), kcpList, client.InNamespace(o.GetNamespace())); err != nil {
+		return nil
+	}
+
+	gvk := o.GetObjectKind().GroupVersionKind()
+
+	requests := make([]reconcile.Request, 0, 1)
+	for _, kcp := range kcpList.Items {
+		ref := kcp.Spec.MachineTemplate
+		if ref.Name == o.GetName() && ref.Kind == gvk.Kind && ref.APIVersion == gvk.GroupVersion().String() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: kcp.Namespace, Name: kcp.Name},
+			})
+		}
+	}
+
+	return requests
+}
+
+// clusterUpdatePredicate ignores Cluster updates unless InfrastructureReady,
+// the ControlPlaneEndpoint, or the pause annotation changed, so unrelated
+// Cluster status churn doesn't trigger a reconcile.
+func clusterUpdatePredicate() predicate.Funcs {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldCluster, ok := e.ObjectOld.(*clusterv1.Cluster)
+			if !ok {
+				return true
+			}
+			newCluster, ok := e.ObjectNew.(*clusterv1.Cluster)
+			if !ok {
+				return true
+			}
+
+			if oldCluster.Status.InfrastructureReady != newCluster.Status.InfrastructureReady {
+				return true
+			}
+			if oldCluster.Spec.ControlPlaneEndpoint != newCluster.Spec.ControlPlaneEndpoint {
+				return true
+			}
+			if annotations.HasPaused(oldCluster) != annotations.HasPaused(newCluster) {
+				return true
+			}
+
+			return false
+		},
+	}
+}
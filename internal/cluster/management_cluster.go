@@ -0,0 +1,123 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cluster provides helpers for reasoning about the health of a
+// workload cluster managed by a JujuControlPlane.
+package cluster
+
+import (
+	"context"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/cluster-api/controllers/remote"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/pkg/errors"
+)
+
+// kubeSystemNamespace is where the static control plane pods and etcd member
+// pods run on a kubeadm/k0s-style control plane node.
+const kubeSystemNamespace = "kube-system"
+
+// ManagementCluster knows how to reach into a workload cluster's API server
+// (via the kubeconfig Secret CAPI's remote package already knows how to read)
+// to answer health questions about its control plane.
+type ManagementCluster struct {
+	Client client.Client
+}
+
+// TargetClusterControlPlaneIsHealthy returns an error describing the first
+// control plane node found to be not Ready, or whose kube-apiserver static
+// pod is not running.
+func (m *ManagementCluster) TargetClusterControlPlaneIsHealthy(ctx context.Context, clusterKey client.ObjectKey, cpName string) error {
+	nodes, remoteClient, err := m.controlPlaneNodes(ctx, clusterKey, cpName)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if !nodeIsReady(node) {
+			return errors.Errorf("node %s is not Ready", node.Name)
+		}
+		if err := staticPodIsRunning(ctx, remoteClient, node.Name, "kube-apiserver"); err != nil {
+			return errors.Wrapf(err, "kube-apiserver is not healthy on node %s", node.Name)
+		}
+	}
+
+	return nil
+}
+
+// TargetClusterEtcdIsHealthy returns an error describing the first control
+// plane node whose etcd static pod is not running.
+func (m *ManagementCluster) TargetClusterEtcdIsHealthy(ctx context.Context, clusterKey client.ObjectKey, cpName string) error {
+	nodes, remoteClient, err := m.controlPlaneNodes(ctx, clusterKey, cpName)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if err := staticPodIsRunning(ctx, remoteClient, node.Name, "etcd"); err != nil {
+			return errors.Wrapf(err, "etcd is not healthy on node %s", node.Name)
+		}
+	}
+
+	return nil
+}
+
+func (m *ManagementCluster) controlPlaneNodes(ctx context.Context, clusterKey client.ObjectKey, cpName string) ([]corev1.Node, client.Client, error) {
+	remoteClient, err := remote.NewClusterClient(ctx, clusterKey.Name, m.Client, clusterKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to build remote client for workload cluster")
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := remoteClient.List(ctx, nodeList, client.HasLabels{"node-role.kubernetes.io/control-plane"}); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list control plane nodes")
+	}
+	if len(nodeList.Items) == 0 {
+		return nil, nil, errors.New("no control plane nodes found in workload cluster")
+	}
+
+	return nodeList.Items, remoteClient, nil
+}
+
+func nodeIsReady(node corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// staticPodIsRunning looks for a Running pod on nodeName whose name starts
+// with podPrefix, matching how kubelet names manifest-driven static pods
+// (e.g. "kube-apiserver-<node>").
+func staticPodIsRunning(ctx context.Context, c client.Client, nodeName, podPrefix string) error {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(kubeSystemNamespace), client.MatchingFields{"spec.nodeName": nodeName}); err != nil {
+		return errors.Wrap(err, "failed to list pods")
+	}
+
+	for _, pod := range podList.Items {
+		if strings.HasPrefix(pod.Name, podPrefix) && pod.Status.Phase == corev1.PodRunning {
+			return nil
+		}
+	}
+
+	return errors.Errorf("%s pod not found running on node %s", podPrefix, nodeName)
+}